@@ -1,7 +1,9 @@
 package logs
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
 	"math"
@@ -10,17 +12,20 @@ import (
 	"strconv"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/armon/circbuf"
 	"github.com/moby/buildkit/client"
 	"github.com/moby/buildkit/identity"
 	"github.com/moby/buildkit/util/progress"
-	"github.com/pkg/errors"
 	"github.com/tonistiigi/units"
 )
 
 var defaultMaxLogSize = 2 * 1024 * 1024
-var defaultMaxLogSpeed = 200 * 1024 // per second
+var defaultLogRateLimit = 200 * 1024  // sustained bytes per second
+var defaultLogRateBurst = 1024 * 1024 // bytes allowed in a single burst
+var defaultMaxLogLineSize = 16 * 1024
+var defaultLogTailSize = 256 * 1024
 
 const (
 	stdout = 1
@@ -29,34 +34,146 @@ const (
 
 var configCheckOnce sync.Once
 
+// Format selects the on-wire framing used for the bytes handed to
+// client.VertexLog.Data (and, when printOutput is set, to stdout/stderr).
+type Format int
+
+const (
+	// FormatRaw emits log bytes unmodified, tagged only by stream number.
+	// This is the historical behavior of NewLogStreams.
+	FormatRaw Format = iota
+	// FormatJSON wraps every write in a json-file-style envelope:
+	// {"time":...,"stream":"stdout|stderr","log":"..."}.
+	FormatJSON
+)
+
+// Options configures NewLogStreamsWithOptions.
+type Options struct {
+	Format Format
+	// Now returns the timestamp used for FormatJSON records. Defaults to
+	// time.Now; overridable so tests can produce deterministic output.
+	Now func() time.Time
+	// OnSinkError is called when a pluggable sink (one registered via
+	// WithSinks) fails a Write. It defaults to logging the error to
+	// stderr. Pluggable sinks are best-effort: their failures never fail
+	// the stream itself, unlike the stdio sink used when printOutput is
+	// set, whose error is returned from Write. Errors from the
+	// progress.Writer are ignored.
+	OnSinkError func(stream int, err error)
+}
+
 func NewLogStreams(ctx context.Context, printOutput bool) (io.WriteCloser, io.WriteCloser, func()) {
-	stdout := newStreamWriter(ctx, stdout, printOutput)
-	stderr := newStreamWriter(ctx, stderr, printOutput)
+	return NewLogStreamsWithOptions(ctx, printOutput, Options{})
+}
+
+// NewLogStreamsWithOptions is like NewLogStreams but allows selecting the
+// record Format (see FormatRaw, FormatJSON) and, for FormatJSON, the
+// timestamp source.
+func NewLogStreamsWithOptions(ctx context.Context, printOutput bool, opt Options) (io.WriteCloser, io.WriteCloser, func()) {
+	if opt.Now == nil {
+		opt.Now = time.Now
+	}
+	stdout := newStreamWriter(ctx, stdout, printOutput, opt)
+	stderr := newStreamWriter(ctx, stderr, printOutput, opt)
 	return stdout, stderr, func() {
 		stdout.flushBuffer()
 		stderr.flushBuffer()
 	}
 }
 
-func newStreamWriter(ctx context.Context, stream int, printOutput bool) *streamWriter {
+func newStreamWriter(ctx context.Context, stream int, printOutput bool, opt Options) *streamWriter {
 	pw, _, _ := progress.NewFromContext(ctx)
+	var coreSink Sink
+	if printOutput {
+		coreSink = StdioSink
+	}
+	onSinkError := opt.OnSinkError
+	if onSinkError == nil {
+		onSinkError = defaultOnSinkError
+	}
 	return &streamWriter{
 		pw:          pw,
 		stream:      stream,
 		printOutput: printOutput,
-		created:     time.Now(),
+		coreSink:    coreSink,
+		sinks:       sinksFromContext(ctx),
+		onSinkError: onSinkError,
+		format:      opt.Format,
+		now:         opt.Now,
 	}
 }
 
+func defaultOnSinkError(stream int, err error) {
+	fmt.Fprintf(os.Stderr, "logs: sink write failed for stream %d: %v\n", stream, err)
+}
+
 type streamWriter struct {
 	pw              progress.Writer
 	stream          int
 	printOutput     bool
-	created         time.Time
-	size            int
 	clipping        bool
 	clipReasonSpeed bool
+	bufMu           sync.Mutex
 	buf             *circbuf.Buffer
+	coreSink        Sink   // StdioSink when printOutput is set; on the critical path
+	sinks           []Sink // registered via WithSinks; best-effort, see onSinkError
+	onSinkError     func(stream int, err error)
+
+	limitMu sync.Mutex // guards size and bucket against concurrent Write calls
+	size    int
+	bucket  *tokenBucket
+
+	format Format
+	now    func() time.Time
+
+	lineMu   sync.Mutex // guards lineSize and pending against concurrent Write/flushBuffer calls
+	lineSize int        // bytes written on the current, still unterminated line
+	pending  []byte     // trailing bytes held back to avoid splitting a line inside a UTF-8 rune
+}
+
+// tokenBucket is a simple token-bucket rate limiter: burst bytes are
+// available immediately, then refill at rate bytes/sec. It replaces the
+// previous cumulative-average formula (elapsed-seconds * rate), which let a
+// vertex silent for an hour dump an unbounded burst immediately afterward,
+// and never re-opened the stream once it had clipped. The bucket itself does
+// not refill when rate <= 0; checkLimit creates no bucket in that case, which
+// disables rate limiting. Safe for concurrent use.
+type tokenBucket struct {
+	mu         sync.Mutex
+	burst      float64
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+func newTokenBucket(burst, rate int) *tokenBucket {
+	return &tokenBucket{
+		burst:      float64(burst),
+		rate:       float64(rate),
+		tokens:     float64(burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// take consumes up to n tokens and returns how many bytes of the requested
+// n are currently allowed. It never blocks.
+func (tb *tokenBucket) take(n int) int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	tb.tokens = math.Min(tb.burst, tb.tokens+now.Sub(tb.lastRefill).Seconds()*tb.rate)
+	tb.lastRefill = now
+
+	allowed := n
+	if tb.tokens < float64(n) {
+		allowed = int(tb.tokens)
+	}
+	if allowed < 0 {
+		allowed = 0
+	}
+	tb.tokens -= float64(allowed)
+	return allowed
 }
 
 func (sw *streamWriter) checkLimit(n int) int {
@@ -65,40 +182,61 @@ func (sw *streamWriter) checkLimit(n int) int {
 		if err == nil {
 			defaultMaxLogSize = int(maxLogSize)
 		}
-		maxLogSpeed, err := strconv.ParseInt(os.Getenv("BUILDKIT_STEP_LOG_MAX_SPEED"), 10, 32)
+		logRateLimit, err := strconv.ParseInt(os.Getenv("BUILDKIT_STEP_LOG_MAX_SPEED"), 10, 32)
+		if err == nil {
+			defaultLogRateLimit = int(logRateLimit)
+		}
+		logRateBurst, err := strconv.ParseInt(os.Getenv("BUILDKIT_STEP_LOG_MAX_BURST"), 10, 32)
+		if err == nil && logRateBurst > 0 {
+			// A burst of 0 would permanently cap the bucket at 0 tokens and
+			// block all output forever; treat <= 0 as "leave the default".
+			defaultLogRateBurst = int(logRateBurst)
+		}
+		maxLogLineSize, err := strconv.ParseInt(os.Getenv("BUILDKIT_STEP_LOG_MAX_LINE_SIZE"), 10, 32)
 		if err == nil {
-			defaultMaxLogSpeed = int(maxLogSpeed)
+			defaultMaxLogLineSize = int(maxLogLineSize)
+		}
+		logTailSize, err := strconv.ParseInt(os.Getenv("BUILDKIT_STEP_LOG_TAIL_SIZE"), 10, 32)
+		if err == nil && logTailSize > 0 {
+			// <= 0 would make circbuf.NewBuffer error out, and Write
+			// propagates that error on every call once clipping starts;
+			// treat it as "leave the default" instead.
+			defaultLogTailSize = int(logTailSize)
 		}
 	})
 
+	sw.limitMu.Lock()
+	defer sw.limitMu.Unlock()
+
 	oldSize := sw.size
 	sw.size += n
 
-	maxSize := -1
-	if defaultMaxLogSpeed != -1 {
-		maxSize = int(math.Ceil(time.Since(sw.created).Seconds())) * defaultMaxLogSpeed
-		sw.clipReasonSpeed = true
+	if defaultMaxLogSize != -1 {
+		if oldSize >= defaultMaxLogSize {
+			sw.clipReasonSpeed = false
+			return 0
+		}
+		if sw.size > defaultMaxLogSize {
+			n = defaultMaxLogSize - oldSize
+		}
 	}
-	if maxSize == -1 || maxSize > defaultMaxLogSize {
-		maxSize = defaultMaxLogSize
+
+	if defaultLogRateLimit <= 0 {
 		sw.clipReasonSpeed = false
+		return n
 	}
 
-	if maxSize != -1 {
-		if maxSize < oldSize {
-			return 0
-		}
-
-		if sw.size > maxSize {
-			return maxSize - oldSize
-		}
+	if sw.bucket == nil {
+		sw.bucket = newTokenBucket(defaultLogRateBurst, defaultLogRateLimit)
 	}
-	return n
+	allowed := sw.bucket.take(n)
+	sw.clipReasonSpeed = allowed < n
+	return allowed
 }
 
 func (sw *streamWriter) clipLimitMessage() string {
 	if sw.clipReasonSpeed {
-		return fmt.Sprintf("%#g/s", units.Bytes(defaultMaxLogSpeed))
+		return fmt.Sprintf("%#g/s (burst %#g)", units.Bytes(defaultLogRateLimit), units.Bytes(defaultLogRateBurst))
 	}
 	return fmt.Sprintf("%#g", units.Bytes(defaultMaxLogSize))
 }
@@ -106,16 +244,20 @@ func (sw *streamWriter) clipLimitMessage() string {
 func (sw *streamWriter) Write(dt []byte) (int, error) {
 	oldSize := len(dt)
 	limit := sw.checkLimit(len(dt))
+
+	sw.bufMu.Lock()
 	if sw.buf == nil && limit < len(dt) {
 		var err error
-		sw.buf, err = circbuf.NewBuffer(256 * 1024)
+		sw.buf, err = circbuf.NewBuffer(int64(defaultLogTailSize))
 		if err != nil {
+			sw.bufMu.Unlock()
 			return 0, err
 		}
 	}
 	if sw.buf != nil {
 		sw.buf.Write(dt)
 	}
+	sw.bufMu.Unlock()
 
 	dt = slices.Clone(dt[:limit])
 
@@ -127,40 +269,250 @@ func (sw *streamWriter) Write(dt []byte) (int, error) {
 		sw.clipping = true
 	}
 
-	_, err := sw.write(dt)
+	_, err := sw.writeLineLimited(dt)
 	if err != nil {
 		return 0, err
 	}
 	return oldSize, nil
 }
 
+// writeLineLimited splits dt into VertexLog records at line boundaries,
+// further splitting any single line that exceeds defaultMaxLogLineSize
+// instead of letting one misbehaving, unbroken line consume the whole
+// size/speed budget in one record. A continuation marker is appended at
+// each forced split point. Incomplete trailing UTF-8 sequences are held
+// back in sw.pending until the rest of the rune arrives on a later Write.
+func (sw *streamWriter) writeLineLimited(dt []byte) (int, error) {
+	total := len(dt)
+	if defaultMaxLogLineSize < 0 {
+		_, err := sw.write(dt)
+		return total, err
+	}
+
+	sw.lineMu.Lock()
+	if len(sw.pending) > 0 {
+		dt = append(sw.pending, dt...)
+		sw.pending = nil
+	}
+	sw.lineMu.Unlock()
+
+	for len(dt) > 0 {
+		hasNL := false
+		segEnd := len(dt)
+		if idx := bytes.IndexByte(dt, '\n'); idx >= 0 {
+			segEnd = idx + 1
+			hasNL = true
+		}
+		segment := dt[:segEnd]
+
+		if !hasNL {
+			if cut := validUTF8Prefix(segment); cut < len(segment) {
+				sw.lineMu.Lock()
+				sw.pending = append(sw.pending, segment[cut:]...)
+				sw.lineMu.Unlock()
+				segment = segment[:cut]
+			}
+		}
+
+		for len(segment) > 0 {
+			sw.lineMu.Lock()
+			remaining := defaultMaxLogLineSize - sw.lineSize
+			if remaining <= 0 {
+				// Earlier writes on this line filled the limit exactly; start
+				// a fresh record instead of forcing a 1-byte cut here, which
+				// could land inside a multi-byte rune. A cut inside a rune
+				// only happens when the configured limit itself is too small
+				// to ever hold a full UTF-8 sequence.
+				sw.lineSize = 0
+				remaining = defaultMaxLogLineSize
+				if remaining < utf8.UTFMax {
+					remaining = 1
+				}
+			}
+			sw.lineMu.Unlock()
+
+			if remaining >= len(segment) {
+				if _, err := sw.write(segment); err != nil {
+					return 0, err
+				}
+				sw.lineMu.Lock()
+				sw.lineSize += len(segment)
+				sw.lineMu.Unlock()
+				break
+			}
+
+			cut := validUTF8Prefix(segment[:remaining])
+			if cut == 0 {
+				if remaining < defaultMaxLogLineSize {
+					// Earlier writes left too little room on this line for
+					// the next rune; start a fresh record rather than cut
+					// inside it.
+					sw.lineMu.Lock()
+					sw.lineSize = 0
+					sw.lineMu.Unlock()
+					continue
+				}
+				cut = remaining
+			}
+			chunk := append(slices.Clone(segment[:cut]), []byte("\n[...continued]\n")...)
+			if _, err := sw.write(chunk); err != nil {
+				return 0, err
+			}
+			segment = segment[cut:]
+			sw.lineMu.Lock()
+			sw.lineSize = 0
+			sw.lineMu.Unlock()
+		}
+
+		if hasNL {
+			sw.lineMu.Lock()
+			sw.lineSize = 0
+			sw.lineMu.Unlock()
+		}
+		dt = dt[segEnd:]
+	}
+	return total, nil
+}
+
+// validUTF8Prefix returns the length of the longest prefix of dt that does
+// not end in a truncated multi-byte UTF-8 sequence, so a split point never
+// falls inside a rune.
+func validUTF8Prefix(dt []byte) int {
+	for i := 1; i <= 4 && i <= len(dt); i++ {
+		if b := dt[len(dt)-i]; utf8.RuneStart(b) {
+			if utf8.FullRune(dt[len(dt)-i:]) {
+				return len(dt)
+			}
+			return len(dt) - i
+		}
+	}
+	return len(dt)
+}
+
 func (sw *streamWriter) write(dt []byte) (int, error) {
 	if len(dt) == 0 {
 		return 0, nil
 	}
+	ts := time.Now()
+	if sw.now != nil {
+		ts = sw.now()
+	}
+
+	out := dt
+	if sw.format == FormatJSON {
+		enc, err := sw.encodeJSON(dt, ts)
+		if err != nil {
+			return 0, err
+		}
+		out = enc
+	}
 	sw.pw.Write(identity.NewID(), client.VertexLog{
 		Stream: sw.stream,
-		Data:   dt,
+		Data:   out,
 	})
-	if sw.printOutput {
-		switch sw.stream {
-		case 1:
-			return os.Stdout.Write(dt)
-		case 2:
-			return os.Stderr.Write(dt)
-		default:
-			return 0, errors.Errorf("invalid stream %d", sw.stream)
+	var coreErr error
+	if sw.coreSink != nil {
+		coreErr = sw.coreSink.Write(sw.stream, out, ts)
+	}
+	// Pluggable sinks registered via WithSinks run regardless of a failing
+	// coreSink (e.g. EPIPE on a closed stdout): a daemon-embedder's durable
+	// log backend must not go down just because the stdio mirror did. Each
+	// sink is itself best-effort, so one failing (a full disk under a
+	// FileSink, a vanished journal under a JournaldSink) must not stop the
+	// others from receiving this record either.
+	for _, sink := range sw.sinks {
+		if err := sink.Write(sw.stream, out, ts); err != nil {
+			sw.onSinkError(sw.stream, err)
 		}
 	}
+	if coreErr != nil {
+		return 0, coreErr
+	}
 	return len(dt), nil
 }
 
+// jsonLogEntry is the on-wire shape of a FormatJSON record, modeled on the
+// Docker json-file log driver so existing tooling can parse it unchanged.
+type jsonLogEntry struct {
+	Time   time.Time `json:"time"`
+	Stream string    `json:"stream"`
+	Log    string    `json:"log"`
+}
+
+func (sw *streamWriter) encodeJSON(dt []byte, ts time.Time) ([]byte, error) {
+	streamName := "stdout"
+	if sw.stream == stderr {
+		streamName = "stderr"
+	}
+	enc, err := json.Marshal(jsonLogEntry{
+		Time:   ts,
+		Stream: streamName,
+		Log:    string(dt),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(enc, '\n'), nil
+}
+
 func (sw *streamWriter) flushBuffer() {
-	if sw.buf == nil {
-		return
+	sw.lineMu.Lock()
+	pending := sw.pending
+	sw.pending = nil
+	sw.lineMu.Unlock()
+	if len(pending) > 0 {
+		// The stream ended mid-rune; emit what we held back rather than
+		// silently dropping it.
+		_, _ = sw.write(pending)
 	}
-	_, _ = sw.write(sw.buf.Bytes())
+	sw.bufMu.Lock()
+	buf := sw.buf
 	sw.buf = nil
+	sw.bufMu.Unlock()
+	if buf == nil {
+		return
+	}
+
+	tail := buf.Bytes()
+	// Bytes written to the ring buffer beyond its capacity were overwritten
+	// and are gone for good; that's the true gap between the clipped point
+	// and the tail we're about to emit.
+	if elided := int(buf.TotalWritten()) - len(tail); elided > 0 {
+		_, _ = sw.write(fmt.Appendf(nil, "\n[...%d bytes elided...]\n[resuming last %d bytes of output]\n", elided, len(tail)))
+	}
+	// Route the tail through writeLineLimited rather than writing it as one
+	// record: the tail buffer (defaultLogTailSize, 256 KiB by default) is
+	// much larger than defaultMaxLogLineSize, so an unbroken line sitting
+	// in it needs the same per-line split every other code path gets.
+	_, _ = sw.writeLineLimited(tail)
+
+	sw.lineMu.Lock()
+	pending = sw.pending
+	sw.pending = nil
+	sw.lineMu.Unlock()
+	if len(pending) > 0 {
+		// The tail ended mid-rune; emit what's left rather than silently
+		// dropping it.
+		_, _ = sw.write(pending)
+	}
+}
+
+// Tail returns up to the last n bytes seen on this stream since logging
+// started to be clipped, without waiting for Close/flushBuffer. Returns nil
+// if the stream was never clipped (no tail buffer was ever needed). n <= 0
+// returns the whole retained tail.
+func (sw *streamWriter) Tail(n int) []byte {
+	sw.bufMu.Lock()
+	defer sw.bufMu.Unlock()
+
+	if sw.buf == nil {
+		return nil
+	}
+	b := sw.buf.Bytes()
+	if n <= 0 || n >= len(b) {
+		return slices.Clone(b)
+	}
+	return slices.Clone(b[len(b)-n:])
 }
 
 func (sw *streamWriter) Close() error {
@@ -168,6 +520,7 @@ func (sw *streamWriter) Close() error {
 }
 
 func LoggerFromContext(ctx context.Context) func([]byte) {
+	sinks := sinksFromContext(ctx)
 	return func(dt []byte) {
 		pw, _, _ := progress.NewFromContext(ctx)
 		defer pw.Close()
@@ -175,5 +528,8 @@ func LoggerFromContext(ctx context.Context) func([]byte) {
 			Stream: stderr,
 			Data:   dt,
 		})
+		for _, sink := range sinks {
+			_ = sink.Write(stderr, dt, time.Now())
+		}
 	}
 }
@@ -0,0 +1,245 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/armon/circbuf"
+	"github.com/moby/buildkit/client"
+)
+
+// fakeProgressWriter is a minimal progress.Writer stand-in that records
+// every VertexLog passed to Write, so tests can assert on emitted records
+// without standing up a real progress pipeline.
+type fakeProgressWriter struct {
+	logs []client.VertexLog
+}
+
+func (w *fakeProgressWriter) Write(_ string, v interface{}) error {
+	if vl, ok := v.(client.VertexLog); ok {
+		w.logs = append(w.logs, vl)
+	}
+	return nil
+}
+
+func (w *fakeProgressWriter) Close() error { return nil }
+
+func TestWriteLineLimitedSplitsOversizedLine(t *testing.T) {
+	orig := defaultMaxLogLineSize
+	defer func() { defaultMaxLogLineSize = orig }()
+	defaultMaxLogLineSize = 8
+
+	pw := &fakeProgressWriter{}
+	sw := &streamWriter{pw: pw, stream: stdout}
+
+	line := []byte("0123456789\n")
+	if _, err := sw.writeLineLimited(line); err != nil {
+		t.Fatalf("writeLineLimited: %v", err)
+	}
+
+	if len(pw.logs) < 2 {
+		t.Fatalf("expected the oversized line to be split into multiple records, got %d", len(pw.logs))
+	}
+	var rebuilt []byte
+	for _, l := range pw.logs[:len(pw.logs)-1] {
+		if !bytes.HasSuffix(l.Data, []byte("\n[...continued]\n")) {
+			t.Errorf("expected a continuation marker on a forced split, got %q", l.Data)
+		}
+		rebuilt = append(rebuilt, bytes.TrimSuffix(l.Data, []byte("\n[...continued]\n"))...)
+	}
+	rebuilt = append(rebuilt, pw.logs[len(pw.logs)-1].Data...)
+	if string(rebuilt) != "0123456789\n" {
+		t.Errorf("split records don't reassemble to the original line: %q", rebuilt)
+	}
+}
+
+// TestWriteLineLimitedDoesNotSplitUTF8RuneAtExactLineBoundary is a
+// regression test for a forced split landing inside a multi-byte rune when
+// sw.lineSize has exactly reached defaultMaxLogLineSize from a prior write.
+func TestWriteLineLimitedDoesNotSplitUTF8RuneAtExactLineBoundary(t *testing.T) {
+	orig := defaultMaxLogLineSize
+	defer func() { defaultMaxLogLineSize = orig }()
+	defaultMaxLogLineSize = utf8.UTFMax
+
+	pw := &fakeProgressWriter{}
+	sw := &streamWriter{pw: pw, stream: stdout}
+
+	// Fill the line-size budget exactly so sw.lineSize == defaultMaxLogLineSize
+	// going into the next write, the scenario that used to trigger a forced
+	// 1-byte cut.
+	if _, err := sw.writeLineLimited([]byte("abcd")); err != nil {
+		t.Fatalf("writeLineLimited: %v", err)
+	}
+
+	euro := "€" // 0xE2 0x82 0xAC
+	if _, err := sw.writeLineLimited([]byte(euro)); err != nil {
+		t.Fatalf("writeLineLimited: %v", err)
+	}
+
+	for _, l := range pw.logs {
+		if !utf8.Valid(l.Data) {
+			t.Errorf("record contains invalid UTF-8, rune was split at a line-limit boundary: %q", l.Data)
+		}
+	}
+}
+
+// recordingSink is a Sink that optionally fails every Write and records
+// whether it was called, so tests can assert on fan-out error isolation.
+type recordingSink struct {
+	fail    bool
+	written int
+}
+
+func (s *recordingSink) Write(_ int, _ []byte, _ time.Time) error {
+	s.written++
+	if s.fail {
+		return errors.New("sink write failed")
+	}
+	return nil
+}
+
+// TestSinkFanOutIsolatesFailingSink checks that a failing pluggable sink,
+// and a failing coreSink (the stdio mirror), don't prevent the other
+// registered sinks from receiving the same record.
+func TestSinkFanOutIsolatesFailingSink(t *testing.T) {
+	failing := &recordingSink{fail: true}
+	healthy := &recordingSink{}
+	var sinkErrs int
+
+	sw := &streamWriter{
+		pw:          &fakeProgressWriter{},
+		stream:      stdout,
+		coreSink:    failing,
+		sinks:       []Sink{failing, healthy},
+		onSinkError: func(int, error) { sinkErrs++ },
+	}
+
+	if _, err := sw.write([]byte("hello\n")); err == nil {
+		t.Error("expected write to report the coreSink error")
+	}
+	if healthy.written != 1 {
+		t.Errorf("healthy sink should still receive the record even though coreSink and another sink failed, written=%d", healthy.written)
+	}
+	if sinkErrs != 1 {
+		t.Errorf("expected exactly one onSinkError call for the failing pluggable sink, got %d", sinkErrs)
+	}
+}
+
+func TestTokenBucketBurstAndRefill(t *testing.T) {
+	tb := newTokenBucket(10, 5) // burst 10 bytes, refill 5 bytes/sec
+
+	if allowed := tb.take(10); allowed != 10 {
+		t.Fatalf("expected the full burst to be available immediately, got %d", allowed)
+	}
+	if allowed := tb.take(1); allowed != 0 {
+		t.Fatalf("expected the bucket to be empty right after burning the burst, got %d", allowed)
+	}
+
+	// Simulate 2 seconds of elapsed time without a real sleep: 2s * 5B/s =
+	// 10 bytes refilled, capped at the 10-byte burst.
+	tb.lastRefill = tb.lastRefill.Add(-2 * time.Second)
+	if allowed := tb.take(20); allowed != 10 {
+		t.Fatalf("expected refill to be capped at burst (10), got %d", allowed)
+	}
+}
+
+// TestFormatJSONUsesInjectableNow exercises Options.Now, the deterministic
+// timestamp source FormatJSON records are meant to use instead of time.Now.
+func TestFormatJSONUsesInjectableNow(t *testing.T) {
+	fixed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	pw := &fakeProgressWriter{}
+	sw := &streamWriter{
+		pw:     pw,
+		stream: stdout,
+		format: FormatJSON,
+		now:    func() time.Time { return fixed },
+	}
+
+	if _, err := sw.write([]byte("hello\n")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if len(pw.logs) != 1 {
+		t.Fatalf("expected exactly one record, got %d", len(pw.logs))
+	}
+
+	var entry jsonLogEntry
+	if err := json.Unmarshal(bytes.TrimRight(pw.logs[0].Data, "\n"), &entry); err != nil {
+		t.Fatalf("record is not valid JSON: %v", err)
+	}
+	if !entry.Time.Equal(fixed) {
+		t.Errorf("expected the injected Now() timestamp %v, got %v", fixed, entry.Time)
+	}
+	if entry.Stream != "stdout" {
+		t.Errorf("expected stream %q, got %q", "stdout", entry.Stream)
+	}
+	if entry.Log != "hello\n" {
+		t.Errorf("expected log %q, got %q", "hello\n", entry.Log)
+	}
+}
+
+// TestFlushBufferReportsElidedBytesAndTail checks that flushing a tail
+// buffer that has wrapped past its capacity reports the true elided-byte
+// count, that Tail() reflects the buffer before the flush, and that Tail()
+// returns nil once flushBuffer has consumed it.
+func TestFlushBufferReportsElidedBytesAndTail(t *testing.T) {
+	orig := defaultMaxLogLineSize
+	defer func() { defaultMaxLogLineSize = orig }()
+	defaultMaxLogLineSize = -1 // keep this test focused on flush/tail, not splitting
+
+	buf, err := circbuf.NewBuffer(8)
+	if err != nil {
+		t.Fatalf("circbuf.NewBuffer: %v", err)
+	}
+	written := []byte("0123456789ABCDE") // 15 bytes into an 8-byte ring
+	if _, err := buf.Write(written); err != nil {
+		t.Fatalf("buf.Write: %v", err)
+	}
+
+	pw := &fakeProgressWriter{}
+	sw := &streamWriter{pw: pw, stream: stdout, buf: buf}
+
+	if got := string(sw.Tail(0)); got != "789ABCDE" {
+		t.Fatalf("Tail(0) before flush = %q, want %q", got, "789ABCDE")
+	}
+	if got := string(sw.Tail(3)); got != "CDE" {
+		t.Fatalf("Tail(3) before flush = %q, want %q", got, "CDE")
+	}
+
+	sw.flushBuffer()
+
+	if len(pw.logs) != 2 {
+		t.Fatalf("expected an elision notice plus the tail record, got %d records", len(pw.logs))
+	}
+	wantNotice := fmt.Appendf(nil, "\n[...%d bytes elided...]\n[resuming last %d bytes of output]\n", 7, 8)
+	if !bytes.Equal(pw.logs[0].Data, wantNotice) {
+		t.Errorf("elision notice = %q, want %q", pw.logs[0].Data, wantNotice)
+	}
+	if string(pw.logs[1].Data) != "789ABCDE" {
+		t.Errorf("tail record = %q, want %q", pw.logs[1].Data, "789ABCDE")
+	}
+
+	if got := sw.Tail(0); got != nil {
+		t.Errorf("Tail(0) after flush should be nil, got %q", got)
+	}
+}
+
+func TestCheckLimitRateZeroDisablesRateLimiting(t *testing.T) {
+	origSize, origRate := defaultMaxLogSize, defaultLogRateLimit
+	defer func() { defaultMaxLogSize, defaultLogRateLimit = origSize, origRate }()
+	defaultMaxLogSize = -1
+	defaultLogRateLimit = 0
+
+	sw := &streamWriter{}
+	if allowed := sw.checkLimit(1 << 20); allowed != 1<<20 {
+		t.Errorf("rate <= 0 should disable rate limiting per the tokenBucket doc comment, got allowed=%d", allowed)
+	}
+	if sw.bucket != nil {
+		t.Error("no tokenBucket should be created when rate limiting is disabled")
+	}
+}
@@ -0,0 +1,57 @@
+package logs
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Sink receives a copy of every byte slice written to a vertex's stdout or
+// stderr stream, alongside the VertexLog record handed to the progress
+// writer. Registering sinks via WithSinks lets a buildkit-embedding daemon
+// (such as moby) redirect step logs to the same backend it already uses for
+// container logs, without patching this package for each new destination.
+type Sink interface {
+	Write(stream int, dt []byte, ts time.Time) error
+}
+
+type sinksKeyT struct{}
+
+var sinksKey sinksKeyT
+
+// WithSinks attaches sinks to ctx. NewLogStreams(WithOptions) and
+// LoggerFromContext write every record to each sink found on ctx, in
+// addition to the progress.Writer they already report to. A sink attached
+// this way is best-effort: a Write failure never aborts the stream. Streams
+// from NewLogStreams(WithOptions) report it via Options.OnSinkError (see
+// streamWriter.write in logs.go); LoggerFromContext discards it.
+func WithSinks(ctx context.Context, sinks ...Sink) context.Context {
+	return context.WithValue(ctx, sinksKey, sinks)
+}
+
+func sinksFromContext(ctx context.Context) []Sink {
+	sinks, _ := ctx.Value(sinksKey).([]Sink)
+	return sinks
+}
+
+// StdioSink is the default Sink used when NewLogStreams is called with
+// printOutput set: it mirrors stream 1 to os.Stdout and stream 2 to
+// os.Stderr, matching this package's historical behavior.
+var StdioSink Sink = stdioSink{}
+
+type stdioSink struct{}
+
+func (stdioSink) Write(stream int, dt []byte, _ time.Time) error {
+	switch stream {
+	case stdout:
+		_, err := os.Stdout.Write(dt)
+		return err
+	case stderr:
+		_, err := os.Stderr.Write(dt)
+		return err
+	default:
+		return errors.Errorf("invalid stream %d", stream)
+	}
+}
@@ -0,0 +1,87 @@
+package logs
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileSink is a Sink that appends writes to a file, rotating it once it
+// would exceed maxSize and keeping up to maxFiles total (the active file
+// plus rotated backups named path.1, path.2, ...). This mirrors the
+// size+count rotation used by container log drivers.
+type FileSink struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+// NewFileSink opens (or creates) path for appending. maxSize <= 0 disables
+// rotation; maxFiles <= 1 keeps no backups, just truncating path on rotation.
+func NewFileSink(path string, maxSize int64, maxFiles int) (*FileSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &FileSink{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+		f:        f,
+		size:     info.Size(),
+	}, nil
+}
+
+func (s *FileSink) Write(_ int, dt []byte, _ time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.maxSize > 0 && s.size+int64(len(dt)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.f.Write(dt)
+	s.size += int64(n)
+	return err
+}
+
+func (s *FileSink) rotate() error {
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+
+	if s.maxFiles > 1 {
+		oldest := fmt.Sprintf("%s.%d", s.path, s.maxFiles-1)
+		_ = os.Remove(oldest)
+		for i := s.maxFiles - 2; i >= 1; i-- {
+			_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+		}
+		_ = os.Rename(s.path, s.path+".1")
+	}
+
+	f, err := os.OpenFile(s.path, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	s.f = f
+	s.size = 0
+	return nil
+}
+
+// Close closes the underlying file. Callers that create a FileSink are
+// responsible for closing it once no more writes will arrive.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.f.Close()
+}
@@ -0,0 +1,36 @@
+package logs
+
+import (
+	"time"
+
+	"github.com/coreos/go-systemd/v22/journal"
+	"github.com/pkg/errors"
+)
+
+// JournaldSink forwards log writes to the local systemd journal, tagging
+// each message's priority by the stream it came from (stdout -> info,
+// stderr -> warning), following the same convention container log drivers
+// use when splitting journald priorities by stream.
+type JournaldSink struct {
+	identifier string
+}
+
+// NewJournaldSink returns a Sink that writes to the local systemd journal,
+// tagging every entry with SYSLOG_IDENTIFIER=identifier. It errors out if
+// the journal is not reachable so callers can fall back to another sink.
+func NewJournaldSink(identifier string) (*JournaldSink, error) {
+	if !journal.Enabled() {
+		return nil, errors.New("systemd journal is not available")
+	}
+	return &JournaldSink{identifier: identifier}, nil
+}
+
+func (s *JournaldSink) Write(stream int, dt []byte, _ time.Time) error {
+	priority := journal.PriInfo
+	if stream == stderr {
+		priority = journal.PriWarning
+	}
+	return journal.Send(string(dt), priority, map[string]string{
+		"SYSLOG_IDENTIFIER": s.identifier,
+	})
+}